@@ -2,28 +2,109 @@ package datadogclient
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
-	"io/ioutil"
 
 	"errors"
 	"github.com/cloudfoundry/sonde-go/events"
 	"log"
+
+	envelopeutil "github.com/cloudfoundry-community/datadog-firehose-nozzle/providers/envelope"
 )
 
 const DefaultAPIURL = "https://app.datadoghq.com/api/v1"
 
+// DefaultMaxPostBytes bounds each chunk's uncompressed JSON body, staying
+// under Datadog's 3.5 MiB series limit.
+const DefaultMaxPostBytes = 3200 * 1024
+
+// DefaultMaxSeriesPerRequest bounds how many series go in a single chunk.
+const DefaultMaxSeriesPerRequest = 10000
+
+// DefaultMaxRetries is how many times a chunk is retried after the initial attempt.
+const DefaultMaxRetries = 4
+
+// DefaultRetryDeadline bounds the total time spent retrying a single chunk.
+const DefaultRetryDeadline = 30 * time.Second
+
+// DefaultFlushInterval is assumed when nothing overrides it via
+// SetFlushInterval, and is reported to Datadog as the Interval of "rate"
+// metrics so it can divide back out to a per-second rate.
+const DefaultFlushInterval = 15 * time.Second
+
+// DefaultTimeout is used when ClientConfig.Timeout is zero.
+const DefaultTimeout = 30 * time.Second
+
+// DefaultHostnameTagKey populates Metric.Host from the envelope's job/index,
+// e.g. "router/2", which lines up with how CF topology is usually browsed.
+const DefaultHostnameTagKey = "bosh_job_name/index"
+
+// validHostnameTagKeys are the HostnameTagKey values hostFor knows how to
+// resolve; anything else falls through to a hostless metric.
+var validHostnameTagKeys = map[string]bool{
+	"ip":                  true,
+	"job":                 true,
+	"index":               true,
+	"deployment":          true,
+	"bosh_job_name/index": true,
+}
+
+// ClientConfig configures the HTTP transport New uses to talk to Datadog.
+type ClientConfig struct {
+	Timeout time.Duration
+
+	// ProxyURL, when set, is used instead of the environment's HTTP_PROXY/
+	// HTTPS_PROXY/NO_PROXY variables.
+	ProxyURL string
+
+	InsecureSkipVerify bool
+	// CACertFile, when set, is a PEM bundle used instead of the system's
+	// root CAs.
+	CACertFile string
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// HostnameTagKey selects which envelope attribute populates Metric.Host:
+	// "ip", "job", "index", "deployment", or the default "bosh_job_name/index"
+	// (job + "/" + index). Empty selects the default.
+	HostnameTagKey string
+}
+
 type Client struct {
 	apiURL                string
 	apiKey                string
 	metricPoints          map[metricKey]metricValue
+	distributionPoints    map[metricKey]metricValue
+	distributionGlobs     []string
+	lastCounterTotal      map[metricKey]uint64
 	prefix                string
 	deployment            string
 	ip                    string
+	hostnameTagKey        string
+	flushInterval         time.Duration
 	totalMessagesReceived uint64
 	totalMetricsSent      uint64
+	maxPostBytes          int
+	maxSeriesPerRequest   int
+	maxRetries            int
+	retryDeadline         time.Duration
+	chunksSent            uint64
+	chunksFailed          uint64
+	bytesSent             uint64
 	httpClient            http.Client
 }
 
@@ -37,8 +118,10 @@ type metricKey struct {
 }
 
 type metricValue struct {
-	tags   []string
-	points []Point
+	datadogType string
+	host        string
+	tags        []string
+	points      []Point
 }
 
 type Payload struct {
@@ -46,11 +129,12 @@ type Payload struct {
 }
 
 type Metric struct {
-	Metric string   `json:"metric"`
-	Points []Point  `json:"points"`
-	Type   string   `json:"type"`
-	Host   string   `json:"host,omitempty"`
-	Tags   []string `json:"tags,omitempty"`
+	Metric   string   `json:"metric"`
+	Points   []Point  `json:"points"`
+	Type     string   `json:"type"`
+	Interval int64    `json:"interval,omitempty"`
+	Host     string   `json:"host,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
 }
 
 type Point struct {
@@ -58,21 +142,143 @@ type Point struct {
 	Value     float64
 }
 
-func New(apiURL string, apiKey string, prefix string, deployment string, ip string) *Client {
-	timeout := time.Duration(30 * time.Second)
-	httpClient := http.Client{
-		Timeout: timeout,
+// DistributionPayload is posted to /api/v1/distribution_points. Unlike
+// Payload, each point carries every raw sample seen in the flush window
+// instead of a single aggregated value, so distributions stay correct when
+// aggregated across nozzle instances.
+type DistributionPayload struct {
+	Series []DistributionMetric `json:"series"`
+}
+
+type DistributionMetric struct {
+	Metric string              `json:"metric"`
+	Points []DistributionPoint `json:"points"`
+	Tags   []string            `json:"tags,omitempty"`
+}
+
+type DistributionPoint struct {
+	Timestamp int64
+	Values    []float64
+}
+
+func New(apiURL string, apiKey string, prefix string, deployment string, ip string, cfg ClientConfig) (*Client, error) {
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	hostnameTagKey := cfg.HostnameTagKey
+	if hostnameTagKey == "" {
+		hostnameTagKey = DefaultHostnameTagKey
+	}
+	if !validHostnameTagKeys[hostnameTagKey] {
+		log.Printf("datadog: unrecognized HostnameTagKey %q, metrics will be hostless", hostnameTagKey)
 	}
 
 	return &Client{
-		apiURL:       apiURL,
-		apiKey:       apiKey,
-		metricPoints: make(map[metricKey]metricValue),
-		prefix:       prefix,
-		deployment:   deployment,
-		ip:           ip,
-		httpClient:   httpClient,
+		apiURL:              apiURL,
+		apiKey:              apiKey,
+		metricPoints:        make(map[metricKey]metricValue),
+		distributionPoints:  make(map[metricKey]metricValue),
+		lastCounterTotal:    make(map[metricKey]uint64),
+		prefix:              prefix,
+		deployment:          deployment,
+		ip:                  ip,
+		hostnameTagKey:      hostnameTagKey,
+		flushInterval:       DefaultFlushInterval,
+		httpClient:          httpClient,
+		maxPostBytes:        DefaultMaxPostBytes,
+		maxSeriesPerRequest: DefaultMaxSeriesPerRequest,
+		maxRetries:          DefaultMaxRetries,
+		retryDeadline:       DefaultRetryDeadline,
+	}, nil
+}
+
+// newHTTPClient builds the http.Client New uses, wiring up a proxy (explicit
+// or from the environment) and optional TLS overrides.
+func newHTTPClient(cfg ClientConfig) (http.Client, error) {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConns:        cfg.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.IdleConnTimeout,
+	}
+
+	if cfg.ProxyURL != "" {
+		parsed, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return http.Client{}, fmt.Errorf("datadogclient: invalid proxy url: %s", err)
+		}
+		transport.Proxy = http.ProxyURL(parsed)
+	}
+
+	if cfg.InsecureSkipVerify || cfg.CACertFile != "" {
+		tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+		if cfg.CACertFile != "" {
+			pool, err := loadCACertPool(cfg.CACertFile)
+			if err != nil {
+				return http.Client{}, err
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	return http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+func loadCACertPool(caCertFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("datadogclient: reading CA cert file: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("datadogclient: no certificates found in %s", caCertFile)
 	}
+
+	return pool, nil
+}
+
+// SetMaxPostBytes overrides the default max uncompressed body size per chunk.
+func (c *Client) SetMaxPostBytes(n int) {
+	c.maxPostBytes = n
+}
+
+// SetMaxSeriesPerRequest overrides the default max series count per chunk.
+func (c *Client) SetMaxSeriesPerRequest(n int) {
+	c.maxSeriesPerRequest = n
+}
+
+// SetMaxRetries overrides the default number of retry attempts per chunk.
+func (c *Client) SetMaxRetries(n int) {
+	c.maxRetries = n
+}
+
+// SetRetryDeadline overrides the default overall deadline for retrying a chunk.
+func (c *Client) SetRetryDeadline(d time.Duration) {
+	c.retryDeadline = d
+}
+
+// SetFlushInterval overrides the default Interval reported alongside "rate"
+// metrics; it should match how often PostMetrics is actually called.
+func (c *Client) SetFlushInterval(d time.Duration) {
+	c.flushInterval = d
+}
+
+// SetDistributionGlobs configures which metric names (after prefixing) are
+// submitted as Datadog distributions instead of series. Patterns use
+// path.Match syntax, e.g. "myapp.latency.*".
+func (c *Client) SetDistributionGlobs(globs []string) {
+	c.distributionGlobs = globs
 }
 
 func (c *Client) AlertSlowConsumerError() {
@@ -81,99 +287,348 @@ func (c *Client) AlertSlowConsumerError() {
 
 func (c *Client) AddMetric(envelope *events.Envelope) {
 	c.totalMessagesReceived++
-	if envelope.GetEventType() != events.Envelope_ValueMetric && envelope.GetEventType() != events.Envelope_CounterEvent {
-		return
+
+	switch envelope.GetEventType() {
+	case events.Envelope_ValueMetric:
+		c.addPoint(metricKey{
+			eventType:  envelope.GetEventType(),
+			name:       envelopeutil.Name(envelope),
+			deployment: envelope.GetDeployment(),
+			job:        envelope.GetJob(),
+			index:      envelope.GetIndex(),
+			ip:         envelope.GetIp(),
+		}, "gauge", envelopeutil.Value(envelope), envelopeutil.Tags(envelope), c.hostFor(envelope), envelope.GetTimestamp())
+	case events.Envelope_CounterEvent:
+		c.addCounterMetric(envelope)
+	case events.Envelope_ContainerMetric:
+		c.addContainerMetric(envelope)
 	}
+}
 
+// addCounterMetric submits a CounterEvent as a "rate" point equal to the
+// delta between this total and the last total seen for the same series,
+// since the firehose gives us a running total but "rate" is divided by
+// Interval on Datadog's side to produce a per-second rate.
+func (c *Client) addCounterMetric(envelope *events.Envelope) {
 	key := metricKey{
 		eventType:  envelope.GetEventType(),
-		name:       getName(envelope),
+		name:       envelopeutil.Name(envelope),
 		deployment: envelope.GetDeployment(),
 		job:        envelope.GetJob(),
 		index:      envelope.GetIndex(),
 		ip:         envelope.GetIp(),
 	}
 
-	mVal := c.metricPoints[key]
-	value := getValue(envelope)
+	total := envelope.GetCounterEvent().GetTotal()
+	last, seen := c.lastCounterTotal[key]
+	c.lastCounterTotal[key] = total
+
+	if !seen || total < last {
+		// First sighting, or the origin restarted and its counter reset:
+		// skip this sample rather than submit a bogus (possibly negative) rate.
+		return
+	}
+
+	delta := total - last
+	c.addPoint(key, "rate", float64(delta), envelopeutil.Tags(envelope), c.hostFor(envelope), envelope.GetTimestamp())
+}
+
+// addPoint records a single sample, routing it to the distribution bucket
+// when its (prefixed) name matches one of distributionGlobs and to the
+// regular series bucket otherwise.
+func (c *Client) addPoint(key metricKey, datadogType string, value float64, tags []string, host string, timestampNanos int64) {
+	bucket := c.metricPoints
+	if c.isDistribution(key.name) {
+		bucket = c.distributionPoints
+	}
 
-	mVal.tags = getTags(envelope)
+	mVal := bucket[key]
+	mVal.datadogType = datadogType
+	mVal.tags = tags
+	mVal.host = host
 	mVal.points = append(mVal.points, Point{
-		Timestamp: envelope.GetTimestamp() / int64(time.Second),
+		Timestamp: timestampNanos / int64(time.Second),
 		Value:     value,
 	})
-
-	c.metricPoints[key] = mVal
+	bucket[key] = mVal
 }
 
-func (c *Client) SendMetricPostRequest(seriesBytes []byte) {
-	url := c.seriesURL()
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(seriesBytes))
-	if req != nil {
-		defer req.Body.Close()
+// hostFor derives Metric.Host from the envelope using the configured
+// hostnameTagKey, so metrics line up with CF topology instead of being
+// hostless.
+func (c *Client) hostFor(envelope *events.Envelope) string {
+	switch c.hostnameTagKey {
+	case "ip":
+		return envelope.GetIp()
+	case "job":
+		return envelope.GetJob()
+	case "index":
+		return envelope.GetIndex()
+	case "deployment":
+		return envelope.GetDeployment()
+	case "bosh_job_name/index":
+		if envelope.GetJob() == "" && envelope.GetIndex() == "" {
+			return ""
+		}
+		return envelope.GetJob() + "/" + envelope.GetIndex()
+	default:
+		return ""
 	}
+}
 
-	if err != nil {
-		log.Printf("new datadog request returned error: %s", err)
-		return
+func (c *Client) isDistribution(name string) bool {
+	fullName := c.prefix + name
+	for _, glob := range c.distributionGlobs {
+		if matched, err := path.Match(glob, fullName); err == nil && matched {
+			return true
+		}
 	}
+	return false
+}
 
-	resp, err := c.httpClient.Do(req)
+func (c *Client) addContainerMetric(envelope *events.Envelope) {
+	container := envelope.GetContainerMetric()
+	tags := envelopeutil.Tags(envelope)
+	tags = envelopeutil.AppendTagIfNotEmpty(tags, "instance_index", fmt.Sprintf("%d", container.GetInstanceIndex()))
+
+	samples := []struct {
+		name  string
+		value float64
+	}{
+		{"containerMetric.cpuPercentage", container.GetCpuPercentage()},
+		{"containerMetric.memoryBytes", float64(container.GetMemoryBytes())},
+		{"containerMetric.diskBytes", float64(container.GetDiskBytes())},
+	}
 
-	if resp != nil {
-		defer resp.Body.Close()
+	host := c.hostFor(envelope)
+
+	for _, sample := range samples {
+		key := metricKey{
+			eventType:  envelope.GetEventType(),
+			name:       envelope.GetOrigin() + "." + sample.name,
+			deployment: envelope.GetDeployment(),
+			job:        envelope.GetJob(),
+			index:      envelope.GetIndex(),
+			ip:         envelope.GetIp(),
+		}
+		c.addPoint(key, "gauge", sample.value, tags, host, envelope.GetTimestamp())
 	}
+}
 
+// sendChunk POSTs a single gzip-compressed chunk and reports whether the
+// failure (if any) is worth retrying, plus how long to wait before retrying.
+func (c *Client) sendChunk(gzipped []byte) (retry bool, retryAfter time.Duration, err error) {
+	req, err := http.NewRequest("POST", c.seriesURL(), bytes.NewReader(gzipped))
 	if err != nil {
-		log.Printf("datadog request returned HTTP response error: %s", err)
-		return
+		return false, 0, fmt.Errorf("new datadog request returned error: %s", err)
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("DD-API-KEY", c.apiKey)
 
-	log.Printf("datadog request returned HTTP response: %s", resp.Status)
-
-	body, err := ioutil.ReadAll(resp.Body)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		log.Printf("Error while read datadog HTTP response: %s", err)
-		return	
+		return true, 0, fmt.Errorf("datadog request returned HTTP response error: %s", err)
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		log.Printf("datadog request returned HTTP response: %s", resp.Status)
+		return false, 0, nil
+	}
+
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr == nil {
 		var data map[string]interface{}
 		json.Unmarshal(body, &data)
 		log.Printf("datadog response: %v", data)
 	}
-}
 
-func (c *Client) PrepareMetrics() []byte {
-	c.populateInternalMetrics()
-	numMetrics := len(c.metricPoints)
-	log.Printf("Posting %d metrics", numMetrics)
+	if resp.StatusCode == 429 || resp.StatusCode >= 500 {
+		return true, retryAfterDuration(resp.Header.Get("Retry-After")), fmt.Errorf("datadog request returned HTTP response: %s", resp.Status)
+	}
 
-	seriesBytes, metricsCount := c.formatMetrics()
+	return false, 0, fmt.Errorf("datadog request returned HTTP response: %s", resp.Status)
+}
 
-	c.totalMetricsSent += metricsCount
-	c.metricPoints = make(map[metricKey]metricValue)
+// sendChunkWithRetry retries sendChunk with exponential backoff and jitter
+// until it succeeds, hits a non-retryable error, exhausts maxRetries, or
+// runs past retryDeadline.
+func (c *Client) sendChunkWithRetry(gzipped []byte) error {
+	deadline := time.Now().Add(c.retryDeadline)
+	var lastErr error
+
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		retry, retryAfter, err := c.sendChunk(gzipped)
+		if err == nil {
+			atomic.AddUint64(&c.bytesSent, uint64(len(gzipped)))
+			return nil
+		}
+
+		lastErr = err
+		if !retry || attempt == c.maxRetries {
+			break
+		}
+
+		wait := retryAfter
+		if wait == 0 {
+			wait = backoffWithJitter(attempt)
+		}
+		if time.Now().Add(wait).After(deadline) {
+			break
+		}
+		log.Printf("datadog: retrying chunk after %s: %s", wait, lastErr)
+		time.Sleep(wait)
+	}
 
-	return seriesBytes
+	return lastErr
 }
 
+func (c *Client) sendChunks(chunks [][]byte) {
+	for _, chunk := range chunks {
+		gzipped, err := gzipPayload(chunk)
+		if err != nil {
+			log.Printf("datadog: failed to gzip metric chunk: %s", err)
+			atomic.AddUint64(&c.chunksFailed, 1)
+			continue
+		}
+
+		if err := c.sendChunkWithRetry(gzipped); err != nil {
+			log.Printf("datadog: giving up on metric chunk: %s", err)
+			atomic.AddUint64(&c.chunksFailed, 1)
+			continue
+		}
+
+		atomic.AddUint64(&c.chunksSent, 1)
+	}
+}
 
 func (c *Client) PostMetrics() error {
-	seriesBytes := c.PrepareMetrics()
-	go c.SendMetricPostRequest(seriesBytes)
+	chunks := c.prepareChunks()
+	go c.sendChunks(chunks)
+
+	distribution := c.prepareDistribution()
+	if distribution != nil {
+		go c.sendDistribution(distribution)
+	}
 
 	return nil
 }
 
+// prepareChunks drains the buffered metric points into JSON series chunks
+// bounded by maxPostBytes and maxSeriesPerRequest.
+func (c *Client) prepareChunks() [][]byte {
+	c.populateInternalMetrics()
+	metrics := c.formatMetrics()
+	log.Printf("Posting %d metrics", len(metrics))
+
+	c.totalMetricsSent += uint64(len(metrics))
+	c.metricPoints = make(map[metricKey]metricValue)
+
+	return c.chunkMetrics(metrics)
+}
+
+// prepareDistribution drains the buffered distribution samples into a single
+// uncompressed JSON distribution_points payload, or nil if there are none;
+// sendDistribution gzips it before posting.
+func (c *Client) prepareDistribution() []byte {
+	if len(c.distributionPoints) == 0 {
+		return nil
+	}
+
+	metrics := c.formatDistribution()
+	c.distributionPoints = make(map[metricKey]metricValue)
+
+	encoded, err := json.Marshal(DistributionPayload{Series: metrics})
+	if err != nil {
+		log.Printf("datadog: failed to marshal distribution payload: %s", err)
+		return nil
+	}
+	return encoded
+}
+
+func (c *Client) chunkMetrics(metrics []Metric) [][]byte {
+	var chunks [][]byte
+	chunk := []Metric{}
+	chunkSize := 0
+
+	flush := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		encoded, err := json.Marshal(Payload{Series: chunk})
+		if err != nil {
+			log.Printf("datadog: failed to marshal metric chunk: %s", err)
+		} else {
+			chunks = append(chunks, encoded)
+		}
+		chunk = []Metric{}
+		chunkSize = 0
+	}
+
+	for _, metric := range metrics {
+		encoded, err := json.Marshal(metric)
+		if err != nil {
+			log.Printf("datadog: failed to marshal metric %q: %s", metric.Metric, err)
+			continue
+		}
+
+		if len(chunk) > 0 && (chunkSize+len(encoded) > c.maxPostBytes || len(chunk) >= c.maxSeriesPerRequest) {
+			flush()
+		}
+
+		chunk = append(chunk, metric)
+		chunkSize += len(encoded)
+	}
+	flush()
+
+	return chunks
+}
+
 func (c *Client) seriesURL() string {
-	url := fmt.Sprintf("%s?api_key=%s", c.apiURL, c.apiKey)
-	return url
+	return c.apiURL
+}
+
+func (c *Client) distributionURL() string {
+	return strings.TrimSuffix(c.apiURL, "/series") + "/distribution_points"
+}
+
+// sendDistribution gzips and POSTs the distribution payload in a single
+// attempt. Unlike series chunks it is not retried: a failed request or a
+// non-2xx response is only logged.
+func (c *Client) sendDistribution(payload []byte) {
+	gzipped, err := gzipPayload(payload)
+	if err != nil {
+		log.Printf("datadog: failed to gzip distribution payload: %s", err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", c.distributionURL(), bytes.NewReader(gzipped))
+	if err != nil {
+		log.Printf("datadog: new distribution request returned error: %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("DD-API-KEY", c.apiKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		log.Printf("datadog: distribution request returned HTTP response error: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	log.Printf("datadog: distribution request returned HTTP response: %s", resp.Status)
+	atomic.AddUint64(&c.bytesSent, uint64(len(gzipped)))
 }
 
 func (c *Client) populateInternalMetrics() {
 	c.addInternalMetric("totalMessagesReceived", c.totalMessagesReceived)
 	c.addInternalMetric("totalMetricsSent", c.totalMetricsSent)
+	c.addInternalMetric("chunksSent", atomic.LoadUint64(&c.chunksSent))
+	c.addInternalMetric("chunksFailed", atomic.LoadUint64(&c.chunksFailed))
+	c.addInternalMetric("bytesSent", atomic.LoadUint64(&c.bytesSent))
 
 	if !c.containsSlowConsumerAlert() {
 		c.addInternalMetric("slowConsumerAlert", uint64(0))
@@ -190,19 +645,59 @@ func (c *Client) containsSlowConsumerAlert() bool {
 	return ok
 }
 
-func (c *Client) formatMetrics() ([]byte, uint64) {
+func (c *Client) formatMetrics() []Metric {
 	metrics := []Metric{}
 	for key, mVal := range c.metricPoints {
-		metrics = append(metrics, Metric{
+		datadogType := mVal.datadogType
+		if datadogType == "" {
+			datadogType = "gauge"
+		}
+
+		metric := Metric{
 			Metric: c.prefix + key.name,
 			Points: mVal.points,
-			Type:   "gauge",
+			Type:   datadogType,
+			Host:   mVal.host,
+			Tags:   mVal.tags,
+		}
+		if datadogType == "rate" {
+			metric.Interval = int64(c.flushInterval / time.Second)
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return metrics
+}
+
+// formatDistribution groups each key's raw samples by timestamp, since
+// Datadog's distribution format is [[ts,[v1,v2,...]], ...] rather than one
+// point per sample.
+func (c *Client) formatDistribution() []DistributionMetric {
+	metrics := []DistributionMetric{}
+	for key, mVal := range c.distributionPoints {
+		byTimestamp := map[int64][]float64{}
+		var order []int64
+		for _, p := range mVal.points {
+			if _, ok := byTimestamp[p.Timestamp]; !ok {
+				order = append(order, p.Timestamp)
+			}
+			byTimestamp[p.Timestamp] = append(byTimestamp[p.Timestamp], p.Value)
+		}
+
+		points := make([]DistributionPoint, 0, len(order))
+		for _, ts := range order {
+			points = append(points, DistributionPoint{Timestamp: ts, Values: byTimestamp[ts]})
+		}
+
+		metrics = append(metrics, DistributionMetric{
+			Metric: c.prefix + key.name,
+			Points: points,
 			Tags:   mVal.tags,
 		})
 	}
 
-	encodedMetric, _ := json.Marshal(Payload{Series: metrics})
-	return encodedMetric, uint64(len(metrics))
+	return metrics
 }
 
 func (c *Client) addInternalMetric(name string, value uint64) {
@@ -228,44 +723,33 @@ func (c *Client) addInternalMetric(name string, value uint64) {
 	c.metricPoints[key] = mValue
 }
 
-func getName(envelope *events.Envelope) string {
-	switch envelope.GetEventType() {
-	case events.Envelope_ValueMetric:
-		return envelope.GetOrigin() + "." + envelope.GetValueMetric().GetName()
-	case events.Envelope_CounterEvent:
-		return envelope.GetOrigin() + "." + envelope.GetCounterEvent().GetName()
-	default:
-		panic("Unknown event type")
+func gzipPayload(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
 	}
-}
-
-func getValue(envelope *events.Envelope) float64 {
-	switch envelope.GetEventType() {
-	case events.Envelope_ValueMetric:
-		return envelope.GetValueMetric().GetValue()
-	case events.Envelope_CounterEvent:
-		return float64(envelope.GetCounterEvent().GetTotal())
-	default:
-		panic("Unknown event type")
+	if err := gz.Close(); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
 }
 
-func getTags(envelope *events.Envelope) []string {
-	var tags []string
-
-	tags = appendTagIfNotEmpty(tags, "deployment", envelope.GetDeployment())
-	tags = appendTagIfNotEmpty(tags, "job", envelope.GetJob())
-	tags = appendTagIfNotEmpty(tags, "index", envelope.GetIndex())
-	tags = appendTagIfNotEmpty(tags, "ip", envelope.GetIp())
-
-	return tags
+// backoffWithJitter returns an exponentially increasing wait with up to 50%
+// jitter, so retrying chunks don't all hammer Datadog in lockstep.
+func backoffWithJitter(attempt int) time.Duration {
+	base := 500 * time.Millisecond * time.Duration(uint64(1)<<uint(attempt))
+	return base/2 + time.Duration(rand.Int63n(int64(base)/2+1))
 }
 
-func appendTagIfNotEmpty(tags []string, key string, value string) []string {
-	if value != "" {
-		tags = append(tags, fmt.Sprintf("%s:%s", key, value))
+func retryAfterDuration(header string) time.Duration {
+	if header == "" {
+		return 0
 	}
-	return tags
+	if secs, err := strconv.Atoi(header); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return 0
 }
 
 func (p Point) MarshalJSON() ([]byte, error) {
@@ -289,3 +773,11 @@ func (p *Point) UnmarshalJSON(in []byte) error {
 
 	return nil
 }
+
+func (p DistributionPoint) MarshalJSON() ([]byte, error) {
+	values, err := json.Marshal(p.Values)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf(`[%d,%s]`, p.Timestamp, values)), nil
+}
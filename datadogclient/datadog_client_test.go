@@ -0,0 +1,425 @@
+package datadogclient
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func testMetrics(n int) []Metric {
+	metrics := make([]Metric, n)
+	for i := range metrics {
+		metrics[i] = Metric{
+			Metric: "test.metric",
+			Type:   "gauge",
+			Points: []Point{{Timestamp: 1, Value: float64(i)}},
+		}
+	}
+	return metrics
+}
+
+func decodeChunks(t *testing.T, chunks [][]byte) []Payload {
+	t.Helper()
+	payloads := make([]Payload, len(chunks))
+	for i, chunk := range chunks {
+		if err := json.Unmarshal(chunk, &payloads[i]); err != nil {
+			t.Fatalf("chunk %d did not decode as a Payload: %s", i, err)
+		}
+	}
+	return payloads
+}
+
+func TestChunkMetricsRespectsMaxSeriesPerRequest(t *testing.T) {
+	c := &Client{maxPostBytes: DefaultMaxPostBytes, maxSeriesPerRequest: 2}
+
+	chunks := c.chunkMetrics(testMetrics(5))
+	payloads := decodeChunks(t, chunks)
+
+	if len(payloads) != 3 {
+		t.Fatalf("got %d chunks, want 3 (2, 2, 1 series)", len(payloads))
+	}
+	for i, want := range []int{2, 2, 1} {
+		if got := len(payloads[i].Series); got != want {
+			t.Errorf("chunk %d has %d series, want %d", i, got, want)
+		}
+	}
+}
+
+func TestChunkMetricsRespectsMaxPostBytes(t *testing.T) {
+	one, err := json.Marshal(testMetrics(1)[0])
+	if err != nil {
+		t.Fatalf("marshal test metric: %s", err)
+	}
+
+	// Allow a little over two metrics' worth of bytes per chunk, so five
+	// metrics should split into three chunks (2, 2, 1) purely on size.
+	c := &Client{maxPostBytes: len(one)*2 + 1, maxSeriesPerRequest: DefaultMaxSeriesPerRequest}
+
+	chunks := c.chunkMetrics(testMetrics(5))
+	payloads := decodeChunks(t, chunks)
+
+	if len(payloads) != 3 {
+		t.Fatalf("got %d chunks, want 3", len(payloads))
+	}
+	for i, want := range []int{2, 2, 1} {
+		if got := len(payloads[i].Series); got != want {
+			t.Errorf("chunk %d has %d series, want %d", i, got, want)
+		}
+	}
+}
+
+func TestChunkMetricsSingleChunkWhenUnderLimits(t *testing.T) {
+	c := &Client{maxPostBytes: DefaultMaxPostBytes, maxSeriesPerRequest: DefaultMaxSeriesPerRequest}
+
+	chunks := c.chunkMetrics(testMetrics(5))
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+}
+
+func TestBackoffWithJitterIsBoundedAndGrows(t *testing.T) {
+	for attempt := 0; attempt < 4; attempt++ {
+		base := 500 * time.Millisecond * (1 << uint(attempt))
+		min := base / 2
+		max := base
+
+		for i := 0; i < 20; i++ {
+			wait := backoffWithJitter(attempt)
+			if wait < min || wait > max {
+				t.Fatalf("backoffWithJitter(%d) = %s, want in [%s, %s]", attempt, wait, min, max)
+			}
+		}
+	}
+}
+
+func TestSendChunkWithRetryGivesUpAfterMaxRetries(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		apiURL:        srv.URL,
+		httpClient:    http.Client{},
+		maxRetries:    2,
+		retryDeadline: 10 * time.Second,
+	}
+
+	if err := c.sendChunkWithRetry([]byte("{}")); err == nil {
+		t.Fatal("expected an error once every attempt returns HTTP 500")
+	}
+
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Fatalf("server saw %d attempts, want maxRetries+1 = 3", got)
+	}
+}
+
+func TestSendChunkWithRetryStopsOnNonRetryableStatus(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		apiURL:        srv.URL,
+		httpClient:    http.Client{},
+		maxRetries:    4,
+		retryDeadline: 10 * time.Second,
+	}
+
+	if err := c.sendChunkWithRetry([]byte("{}")); err == nil {
+		t.Fatal("expected an error for HTTP 400")
+	}
+
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Fatalf("server saw %d attempts, want 1 since HTTP 400 isn't retryable", got)
+	}
+}
+
+func TestFormatDistributionGroupsSamplesByTimestamp(t *testing.T) {
+	c := &Client{
+		prefix: "nozzle.",
+		distributionPoints: map[metricKey]metricValue{
+			{name: "requestLatency"}: {
+				tags: []string{"job:router"},
+				points: []Point{
+					{Timestamp: 100, Value: 1},
+					{Timestamp: 100, Value: 2},
+					{Timestamp: 200, Value: 3},
+				},
+			},
+		},
+	}
+
+	metrics := c.formatDistribution()
+	if len(metrics) != 1 {
+		t.Fatalf("got %d distribution metrics, want 1", len(metrics))
+	}
+
+	metric := metrics[0]
+	if metric.Metric != "nozzle.requestLatency" {
+		t.Errorf("Metric = %q, want %q", metric.Metric, "nozzle.requestLatency")
+	}
+	if len(metric.Points) != 2 {
+		t.Fatalf("got %d points, want 2 (one per distinct timestamp)", len(metric.Points))
+	}
+
+	if metric.Points[0].Timestamp != 100 || len(metric.Points[0].Values) != 2 {
+		t.Errorf("Points[0] = %+v, want timestamp 100 with 2 values", metric.Points[0])
+	}
+	if metric.Points[1].Timestamp != 200 || len(metric.Points[1].Values) != 1 {
+		t.Errorf("Points[1] = %+v, want timestamp 200 with 1 value", metric.Points[1])
+	}
+}
+
+func TestSendChunkWithRetryStopsAtDeadline(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := &Client{
+		apiURL:        srv.URL,
+		httpClient:    http.Client{},
+		maxRetries:    DefaultMaxRetries,
+		retryDeadline: 1 * time.Millisecond,
+	}
+
+	if err := c.sendChunkWithRetry([]byte("{}")); err == nil {
+		t.Fatal("expected an error once the retry deadline is exhausted")
+	}
+
+	// The deadline is shorter than even the first backoff, so only the
+	// initial attempt should happen before giving up.
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Fatalf("server saw %d attempts, want 1 given a near-zero retry deadline", got)
+	}
+}
+
+func testEnvelope(deployment, job, index, ip string) *events.Envelope {
+	eventType := events.Envelope_ValueMetric
+	origin := "origin"
+	return &events.Envelope{
+		Origin:     &origin,
+		EventType:  &eventType,
+		Deployment: &deployment,
+		Job:        &job,
+		Index:      &index,
+		Ip:         &ip,
+	}
+}
+
+func testCounterEnvelope(name string, total uint64) *events.Envelope {
+	eventType := events.Envelope_CounterEvent
+	origin := "origin"
+	return &events.Envelope{
+		Origin:    &origin,
+		EventType: &eventType,
+		CounterEvent: &events.CounterEvent{
+			Name:  &name,
+			Total: &total,
+		},
+	}
+}
+
+func newTestClientForAddMetric() *Client {
+	return &Client{
+		metricPoints:       make(map[metricKey]metricValue),
+		distributionPoints: make(map[metricKey]metricValue),
+		lastCounterTotal:   make(map[metricKey]uint64),
+	}
+}
+
+func soleMetricValue(t *testing.T, points map[metricKey]metricValue) metricValue {
+	t.Helper()
+	if len(points) != 1 {
+		t.Fatalf("got %d metricPoints entries, want 1", len(points))
+	}
+	for _, v := range points {
+		return v
+	}
+	panic("unreachable")
+}
+
+func TestAddMetricCounterFirstSightingIsSkipped(t *testing.T) {
+	c := newTestClientForAddMetric()
+
+	c.AddMetric(testCounterEnvelope("requests", 10))
+
+	if len(c.metricPoints) != 0 {
+		t.Fatalf("expected the first sighting of a counter to submit no point, got %d", len(c.metricPoints))
+	}
+}
+
+func TestAddMetricCounterEmitsDeltaAsRate(t *testing.T) {
+	c := newTestClientForAddMetric()
+
+	c.AddMetric(testCounterEnvelope("requests", 10))
+	c.AddMetric(testCounterEnvelope("requests", 15))
+
+	mVal := soleMetricValue(t, c.metricPoints)
+	if mVal.datadogType != "rate" {
+		t.Errorf("datadogType = %q, want %q", mVal.datadogType, "rate")
+	}
+	if len(mVal.points) != 1 || mVal.points[0].Value != 5 {
+		t.Fatalf("points = %+v, want a single point with value 5 (the delta, not the total)", mVal.points)
+	}
+}
+
+func TestAddMetricCounterSkipsOnReset(t *testing.T) {
+	c := newTestClientForAddMetric()
+
+	c.AddMetric(testCounterEnvelope("requests", 100))
+	c.AddMetric(testCounterEnvelope("requests", 3))
+
+	if len(c.metricPoints) != 0 {
+		t.Fatalf("expected a restarted (lower) counter total to be skipped rather than emit a negative delta, got %d points", len(c.metricPoints))
+	}
+
+	// The next sample establishes a fresh baseline rather than staying stuck.
+	c.AddMetric(testCounterEnvelope("requests", 8))
+
+	mVal := soleMetricValue(t, c.metricPoints)
+	if len(mVal.points) != 1 || mVal.points[0].Value != 5 {
+		t.Fatalf("points = %+v, want a single point with value 5 once a new baseline is recorded", mVal.points)
+	}
+}
+
+func TestHostForUsesConfiguredTagKey(t *testing.T) {
+	envelope := testEnvelope("cf-warden", "router", "2", "10.0.0.1")
+
+	cases := []struct {
+		hostnameTagKey string
+		want           string
+	}{
+		{"ip", "10.0.0.1"},
+		{"job", "router"},
+		{"index", "2"},
+		{"deployment", "cf-warden"},
+		{"bosh_job_name/index", "router/2"},
+		{"", ""},
+		{"nonsense", ""},
+	}
+
+	for _, tc := range cases {
+		c := &Client{hostnameTagKey: tc.hostnameTagKey}
+		if got := c.hostFor(envelope); got != tc.want {
+			t.Errorf("hostFor() with hostnameTagKey %q = %q, want %q", tc.hostnameTagKey, got, tc.want)
+		}
+	}
+}
+
+func TestHostForBoshJobNameIndexEmptyWhenJobAndIndexMissing(t *testing.T) {
+	c := &Client{hostnameTagKey: "bosh_job_name/index"}
+
+	if got := c.hostFor(testEnvelope("cf-warden", "", "", "10.0.0.1")); got != "" {
+		t.Errorf("hostFor() = %q, want empty when job and index are both unset", got)
+	}
+}
+
+func TestNewHTTPClientHonorsProxyURL(t *testing.T) {
+	client, err := newHTTPClient(ClientConfig{ProxyURL: "http://proxy.example.com:8080"})
+	if err != nil {
+		t.Fatalf("newHTTPClient() returned error: %s", err)
+	}
+
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Transport = %T, want *http.Transport", client.Transport)
+	}
+
+	req, _ := http.NewRequest("GET", "https://app.datadoghq.com", nil)
+	proxyURL, err := transport.Proxy(req)
+	if err != nil {
+		t.Fatalf("Proxy(req) returned error: %s", err)
+	}
+	if got, want := proxyURL.String(), "http://proxy.example.com:8080"; got != want {
+		t.Errorf("Proxy(req) = %q, want %q", got, want)
+	}
+}
+
+func TestNewHTTPClientRejectsInvalidProxyURL(t *testing.T) {
+	if _, err := newHTTPClient(ClientConfig{ProxyURL: "://not-a-url"}); err == nil {
+		t.Fatal("expected an error for an unparseable proxy url")
+	}
+}
+
+func TestNewHTTPClientHonorsInsecureSkipVerify(t *testing.T) {
+	client, err := newHTTPClient(ClientConfig{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("newHTTPClient() returned error: %s", err)
+	}
+
+	transport := client.Transport.(*http.Transport)
+	if transport.TLSClientConfig == nil || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Fatal("expected TLSClientConfig.InsecureSkipVerify to be true")
+	}
+}
+
+// writeTestCACert generates a self-signed certificate and writes its PEM
+// encoding to a file under t.TempDir(), returning the file path.
+func writeTestCACert(t *testing.T) string {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(path, pemBytes, 0o600); err != nil {
+		t.Fatalf("write CA cert file: %s", err)
+	}
+	return path
+}
+
+func TestNewHTTPClientLoadsCACertFile(t *testing.T) {
+	caCertFile := writeTestCACert(t)
+
+	client, err := newHTTPClient(ClientConfig{CACertFile: caCertFile})
+	if err != nil {
+		t.Fatalf("newHTTPClient() returned error: %s", err)
+	}
+
+	transport := client.Transport.(*http.Transport)
+	if transport.TLSClientConfig == nil || transport.TLSClientConfig.RootCAs == nil {
+		t.Fatal("expected TLSClientConfig.RootCAs to be populated from CACertFile")
+	}
+}
+
+func TestNewHTTPClientRejectsMissingCACertFile(t *testing.T) {
+	if _, err := newHTTPClient(ClientConfig{CACertFile: "/no/such/file.pem"}); err == nil {
+		t.Fatal("expected an error for a missing CA cert file")
+	}
+}
@@ -0,0 +1,56 @@
+// Package envelope centralizes the ValueMetric/CounterEvent translation
+// logic (name, value, tags) shared by every metrics backend, so a fix here
+// doesn't need to be copy-pasted into datadogclient, influxdb and
+// prometheusremotewrite separately.
+package envelope
+
+import (
+	"fmt"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Name returns the dotted metric name for a ValueMetric or CounterEvent envelope.
+func Name(envelope *events.Envelope) string {
+	switch envelope.GetEventType() {
+	case events.Envelope_ValueMetric:
+		return envelope.GetOrigin() + "." + envelope.GetValueMetric().GetName()
+	case events.Envelope_CounterEvent:
+		return envelope.GetOrigin() + "." + envelope.GetCounterEvent().GetName()
+	default:
+		panic("Unknown event type")
+	}
+}
+
+// Value returns the numeric value for a ValueMetric or CounterEvent envelope.
+func Value(envelope *events.Envelope) float64 {
+	switch envelope.GetEventType() {
+	case events.Envelope_ValueMetric:
+		return envelope.GetValueMetric().GetValue()
+	case events.Envelope_CounterEvent:
+		return float64(envelope.GetCounterEvent().GetTotal())
+	default:
+		panic("Unknown event type")
+	}
+}
+
+// Tags returns the deployment/job/index/ip tags common to every envelope, as
+// "key:value" pairs.
+func Tags(envelope *events.Envelope) []string {
+	var tags []string
+
+	tags = AppendTagIfNotEmpty(tags, "deployment", envelope.GetDeployment())
+	tags = AppendTagIfNotEmpty(tags, "job", envelope.GetJob())
+	tags = AppendTagIfNotEmpty(tags, "index", envelope.GetIndex())
+	tags = AppendTagIfNotEmpty(tags, "ip", envelope.GetIp())
+
+	return tags
+}
+
+// AppendTagIfNotEmpty appends a "key:value" tag, skipping empty values.
+func AppendTagIfNotEmpty(tags []string, key string, value string) []string {
+	if value != "" {
+		tags = append(tags, fmt.Sprintf("%s:%s", key, value))
+	}
+	return tags
+}
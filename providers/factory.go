@@ -0,0 +1,106 @@
+package providers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry-community/datadog-firehose-nozzle/datadogclient"
+	"github.com/cloudfoundry-community/datadog-firehose-nozzle/providers/influxdb"
+	"github.com/cloudfoundry-community/datadog-firehose-nozzle/providers/multi"
+	"github.com/cloudfoundry-community/datadog-firehose-nozzle/providers/prometheusremotewrite"
+	"github.com/cloudfoundry-community/datadog-firehose-nozzle/statsdclient"
+)
+
+// Config selects and configures the metrics backend(s) the nozzle posts to.
+type Config struct {
+	// Type is one of "datadog" (default), "influxdb", "prometheus_remote_write",
+	// "statsd" or "multi". When Type is "multi", Types lists the backends to
+	// fan out to.
+	Type  string
+	Types []string
+
+	APIURL     string
+	APIKey     string
+	Prefix     string
+	Deployment string
+	IP         string
+
+	InfluxDBURL      string
+	InfluxDBDatabase string
+
+	PrometheusRemoteWriteURL string
+
+	// StatsDNetwork is "udp" or "unixgram"; StatsDAddress is the Datadog
+	// Agent's DogStatsD address (host:port for UDP, socket path for unixgram).
+	StatsDNetwork       string
+	StatsDAddress       string
+	StatsDMaxPacketSize int
+
+	// Datadog* configure the HTTP transport and host attribution used by the
+	// "datadog" backend; see datadogclient.ClientConfig.
+	DatadogTimeout            time.Duration
+	DatadogProxyURL           string
+	DatadogInsecureSkipVerify bool
+	DatadogCACertFile         string
+	DatadogHostnameTagKey     string
+
+	// DatadogDistributionGlobs selects, by glob against the prefixed metric
+	// name, which metrics are posted as distributions instead of series.
+	DatadogDistributionGlobs []string
+	// DatadogFlushInterval overrides datadogclient.DefaultFlushInterval.
+	DatadogFlushInterval time.Duration
+}
+
+// New builds the MetricsProvider selected by cfg.Type.
+func New(cfg Config) (MetricsProvider, error) {
+	switch cfg.Type {
+	case "", "datadog":
+		client, err := datadogclient.New(cfg.APIURL, cfg.APIKey, cfg.Prefix, cfg.Deployment, cfg.IP, datadogclient.ClientConfig{
+			Timeout:            cfg.DatadogTimeout,
+			ProxyURL:           cfg.DatadogProxyURL,
+			InsecureSkipVerify: cfg.DatadogInsecureSkipVerify,
+			CACertFile:         cfg.DatadogCACertFile,
+			HostnameTagKey:     cfg.DatadogHostnameTagKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(cfg.DatadogDistributionGlobs) > 0 {
+			client.SetDistributionGlobs(cfg.DatadogDistributionGlobs)
+		}
+		if cfg.DatadogFlushInterval > 0 {
+			client.SetFlushInterval(cfg.DatadogFlushInterval)
+		}
+		return client, nil
+	case "influxdb":
+		return influxdb.New(cfg.InfluxDBURL, cfg.InfluxDBDatabase, cfg.Prefix, cfg.Deployment, cfg.IP), nil
+	case "prometheus_remote_write":
+		return prometheusremotewrite.New(cfg.PrometheusRemoteWriteURL, cfg.Prefix, cfg.Deployment, cfg.IP), nil
+	case "statsd":
+		client, err := statsdclient.New(cfg.StatsDNetwork, cfg.StatsDAddress, cfg.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.StatsDMaxPacketSize > 0 {
+			client.SetMaxPacketSize(cfg.StatsDMaxPacketSize)
+		}
+		return client, nil
+	case "multi":
+		fanout := make([]MetricsProvider, 0, len(cfg.Types))
+		for _, t := range cfg.Types {
+			if t == "multi" {
+				return nil, fmt.Errorf("providers: \"multi\" cannot list itself in Types")
+			}
+			sub := cfg
+			sub.Type = t
+			provider, err := New(sub)
+			if err != nil {
+				return nil, err
+			}
+			fanout = append(fanout, provider)
+		}
+		return multi.New(fanout...), nil
+	default:
+		return nil, fmt.Errorf("providers: unknown metrics provider type %q", cfg.Type)
+	}
+}
@@ -0,0 +1,35 @@
+package providers
+
+import "testing"
+
+func TestNewRejectsUnknownType(t *testing.T) {
+	if _, err := New(Config{Type: "bogus"}); err == nil {
+		t.Fatal("expected an error for an unknown provider type")
+	}
+}
+
+func TestNewMultiRejectsSelfNesting(t *testing.T) {
+	_, err := New(Config{Type: "multi", Types: []string{"multi", "datadog"}})
+	if err == nil {
+		t.Fatal("expected an error when \"multi\" lists itself in Types, not infinite recursion")
+	}
+}
+
+func TestNewMultiFansOutToEachType(t *testing.T) {
+	provider, err := New(Config{
+		Type:  "multi",
+		Types: []string{"statsd", "influxdb"},
+
+		StatsDNetwork: "udp",
+		StatsDAddress: "127.0.0.1:8125",
+
+		InfluxDBURL:      "http://example.invalid",
+		InfluxDBDatabase: "nozzle",
+	})
+	if err != nil {
+		t.Fatalf("New() returned error: %s", err)
+	}
+	if provider == nil {
+		t.Fatal("New() returned a nil provider")
+	}
+}
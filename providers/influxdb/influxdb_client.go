@@ -0,0 +1,166 @@
+// Package influxdb implements providers.MetricsProvider by buffering
+// firehose envelopes and flushing them to InfluxDB's /write endpoint as
+// line protocol.
+package influxdb
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+
+	envelopeutil "github.com/cloudfoundry-community/datadog-firehose-nozzle/providers/envelope"
+)
+
+type Client struct {
+	dbURL        string
+	database     string
+	prefix       string
+	deployment   string
+	ip           string
+	metricPoints map[metricKey]metricValue
+	httpClient   http.Client
+}
+
+type metricKey struct {
+	eventType  events.Envelope_EventType
+	name       string
+	deployment string
+	job        string
+	index      string
+	ip         string
+}
+
+type metricValue struct {
+	tags   map[string]string
+	points []point
+}
+
+type point struct {
+	timestamp int64
+	value     float64
+}
+
+func New(dbURL string, database string, prefix string, deployment string, ip string) *Client {
+	return &Client{
+		dbURL:        dbURL,
+		database:     database,
+		prefix:       prefix,
+		deployment:   deployment,
+		ip:           ip,
+		metricPoints: make(map[metricKey]metricValue),
+		httpClient:   http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *Client) AlertSlowConsumerError() {
+	c.addInternalMetric("slowConsumerAlert", 1)
+}
+
+func (c *Client) AddMetric(envelope *events.Envelope) {
+	if envelope.GetEventType() != events.Envelope_ValueMetric && envelope.GetEventType() != events.Envelope_CounterEvent {
+		return
+	}
+
+	key := metricKey{
+		eventType:  envelope.GetEventType(),
+		name:       envelopeutil.Name(envelope),
+		deployment: envelope.GetDeployment(),
+		job:        envelope.GetJob(),
+		index:      envelope.GetIndex(),
+		ip:         envelope.GetIp(),
+	}
+
+	mVal := c.metricPoints[key]
+	mVal.tags = tagsMap(envelope)
+	mVal.points = append(mVal.points, point{
+		timestamp: envelope.GetTimestamp(),
+		value:     envelopeutil.Value(envelope),
+	})
+	c.metricPoints[key] = mVal
+}
+
+func (c *Client) PostMetrics() error {
+	lines := c.formatLineProtocol()
+	c.metricPoints = make(map[metricKey]metricValue)
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return c.write(lines)
+}
+
+func (c *Client) write(lines []byte) error {
+	writeURL := fmt.Sprintf("%s/write?db=%s", strings.TrimRight(c.dbURL, "/"), url.QueryEscape(c.database))
+
+	resp, err := c.httpClient.Post(writeURL, "text/plain", bytes.NewReader(lines))
+	if err != nil {
+		return fmt.Errorf("influxdb: write request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		return fmt.Errorf("influxdb: write returned HTTP %s", resp.Status)
+	}
+
+	log.Printf("influxdb: wrote metrics, response: %s", resp.Status)
+	return nil
+}
+
+// formatLineProtocol renders the buffered metrics as InfluxDB line protocol:
+// measurement,tag=value,... field=value timestamp
+func (c *Client) formatLineProtocol() []byte {
+	var buf bytes.Buffer
+
+	for key, mVal := range c.metricPoints {
+		measurement := escapeLineProtocol(c.prefix + key.name)
+
+		var tagPairs []string
+		for k, v := range mVal.tags {
+			tagPairs = append(tagPairs, fmt.Sprintf("%s=%s", escapeLineProtocol(k), escapeLineProtocol(v)))
+		}
+
+		for _, p := range mVal.points {
+			buf.WriteString(measurement)
+			for _, tag := range tagPairs {
+				buf.WriteByte(',')
+				buf.WriteString(tag)
+			}
+			buf.WriteString(fmt.Sprintf(" value=%f %d\n", p.value, p.timestamp))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func (c *Client) addInternalMetric(name string, value float64) {
+	key := metricKey{name: name, deployment: c.deployment, ip: c.ip}
+	mVal := c.metricPoints[key]
+	mVal.tags = map[string]string{"ip": c.ip, "deployment": c.deployment}
+	mVal.points = append(mVal.points, point{timestamp: time.Now().UnixNano(), value: value})
+	c.metricPoints[key] = mVal
+}
+
+// tagsMap adapts the shared "key:value" tag list to the map shape line
+// protocol tags need.
+func tagsMap(envelope *events.Envelope) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range envelopeutil.Tags(envelope) {
+		if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+			tags[tag[:idx]] = tag[idx+1:]
+		}
+	}
+	return tags
+}
+
+var lineProtocolReplacer = strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=")
+
+func escapeLineProtocol(s string) string {
+	return lineProtocolReplacer.Replace(s)
+}
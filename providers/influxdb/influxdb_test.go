@@ -0,0 +1,58 @@
+package influxdb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func testValueEnvelope(name string, value float64) *events.Envelope {
+	eventType := events.Envelope_ValueMetric
+	origin := "origin"
+	job := "router"
+	return &events.Envelope{
+		Origin:    &origin,
+		EventType: &eventType,
+		Job:       &job,
+		ValueMetric: &events.ValueMetric{
+			Name:  &name,
+			Value: &value,
+		},
+	}
+}
+
+func TestFormatLineProtocolIncludesMeasurementTagsAndValue(t *testing.T) {
+	c := New("http://influxdb.example.com", "nozzle", "prefix.", "cf-warden", "10.0.0.1")
+	c.AddMetric(testValueEnvelope("latency", 42))
+
+	lines := string(c.formatLineProtocol())
+	if !strings.Contains(lines, "prefix.origin.latency") {
+		t.Fatalf("line protocol = %q, want it to contain the prefixed measurement name", lines)
+	}
+	if !strings.Contains(lines, "job=router") {
+		t.Fatalf("line protocol = %q, want a job=router tag", lines)
+	}
+	if !strings.Contains(lines, "value=42.000000") {
+		t.Fatalf("line protocol = %q, want a value=42.000000 field", lines)
+	}
+}
+
+func TestFormatLineProtocolEscapesReservedCharacters(t *testing.T) {
+	if got, want := escapeLineProtocol("a,b c=d"), `a\,b\ c\=d`; got != want {
+		t.Errorf("escapeLineProtocol() = %q, want %q", got, want)
+	}
+}
+
+func TestPostMetricsClearsBufferedPoints(t *testing.T) {
+	c := New("http://127.0.0.1:0", "nozzle", "prefix.", "cf-warden", "10.0.0.1")
+	c.AddMetric(testValueEnvelope("latency", 42))
+
+	// The write itself will fail since nothing is listening, but the
+	// buffered points should still be cleared for the next flush window.
+	_ = c.PostMetrics()
+
+	if len(c.metricPoints) != 0 {
+		t.Fatalf("metricPoints after PostMetrics = %d, want 0", len(c.metricPoints))
+	}
+}
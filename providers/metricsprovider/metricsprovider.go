@@ -0,0 +1,16 @@
+// Package metricsprovider holds the MetricsProvider interface in its own
+// leaf package so that both providers (the factory) and providers/multi (a
+// MetricsProvider implementation) can depend on it without a cycle.
+package metricsprovider
+
+import "github.com/cloudfoundry/sonde-go/events"
+
+// MetricsProvider is implemented by each metrics backend (Datadog, InfluxDB,
+// Prometheus remote_write, ...). The nozzle feeds every firehose envelope to
+// AddMetric and calls PostMetrics on each flush tick; it never needs to know
+// which backend is behind the interface.
+type MetricsProvider interface {
+	AddMetric(envelope *events.Envelope)
+	PostMetrics() error
+	AlertSlowConsumerError()
+}
@@ -0,0 +1,45 @@
+// Package multi fans a single firehose stream out to several metrics
+// backends at once, so operators can point one nozzle at e.g. Datadog and
+// Prometheus simultaneously.
+package multi
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+
+	"github.com/cloudfoundry-community/datadog-firehose-nozzle/providers/metricsprovider"
+)
+
+// Provider implements metricsprovider.MetricsProvider (aliased as
+// providers.MetricsProvider) by delegating every call to each of the wrapped
+// providers in turn.
+type Provider struct {
+	providers []metricsprovider.MetricsProvider
+}
+
+func New(p ...metricsprovider.MetricsProvider) *Provider {
+	return &Provider{providers: p}
+}
+
+func (p *Provider) AddMetric(envelope *events.Envelope) {
+	for _, provider := range p.providers {
+		provider.AddMetric(envelope)
+	}
+}
+
+// PostMetrics posts to every wrapped provider and returns the first error
+// encountered, after giving every provider a chance to flush.
+func (p *Provider) PostMetrics() error {
+	var firstErr error
+	for _, provider := range p.providers {
+		if err := provider.PostMetrics(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (p *Provider) AlertSlowConsumerError() {
+	for _, provider := range p.providers {
+		provider.AlertSlowConsumerError()
+	}
+}
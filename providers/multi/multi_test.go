@@ -0,0 +1,68 @@
+package multi
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+type fakeProvider struct {
+	addMetricCalls         int
+	postMetricsCalls       int
+	alertSlowConsumerCalls int
+	postMetricsErr         error
+}
+
+func (f *fakeProvider) AddMetric(envelope *events.Envelope) { f.addMetricCalls++ }
+func (f *fakeProvider) PostMetrics() error {
+	f.postMetricsCalls++
+	return f.postMetricsErr
+}
+func (f *fakeProvider) AlertSlowConsumerError() { f.alertSlowConsumerCalls++ }
+
+func TestAddMetricDelegatesToEveryProvider(t *testing.T) {
+	a, b := &fakeProvider{}, &fakeProvider{}
+	p := New(a, b)
+
+	p.AddMetric(&events.Envelope{})
+
+	if a.addMetricCalls != 1 || b.addMetricCalls != 1 {
+		t.Fatalf("addMetricCalls = (%d, %d), want (1, 1)", a.addMetricCalls, b.addMetricCalls)
+	}
+}
+
+func TestAlertSlowConsumerErrorDelegatesToEveryProvider(t *testing.T) {
+	a, b := &fakeProvider{}, &fakeProvider{}
+	p := New(a, b)
+
+	p.AlertSlowConsumerError()
+
+	if a.alertSlowConsumerCalls != 1 || b.alertSlowConsumerCalls != 1 {
+		t.Fatalf("alertSlowConsumerCalls = (%d, %d), want (1, 1)", a.alertSlowConsumerCalls, b.alertSlowConsumerCalls)
+	}
+}
+
+func TestPostMetricsCallsEveryProviderAndReturnsFirstError(t *testing.T) {
+	errA := errors.New("provider a failed")
+	a := &fakeProvider{postMetricsErr: errA}
+	b := &fakeProvider{postMetricsErr: errors.New("provider b failed")}
+	p := New(a, b)
+
+	err := p.PostMetrics()
+
+	if a.postMetricsCalls != 1 || b.postMetricsCalls != 1 {
+		t.Fatalf("postMetricsCalls = (%d, %d), want (1, 1) even after a's error", a.postMetricsCalls, b.postMetricsCalls)
+	}
+	if err != errA {
+		t.Fatalf("PostMetrics() = %v, want the first provider's error", err)
+	}
+}
+
+func TestPostMetricsReturnsNilWhenNoProviderErrors(t *testing.T) {
+	p := New(&fakeProvider{}, &fakeProvider{})
+
+	if err := p.PostMetrics(); err != nil {
+		t.Fatalf("PostMetrics() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,179 @@
+// Package prometheusremotewrite implements providers.MetricsProvider by
+// buffering firehose envelopes and flushing them to a Prometheus
+// remote_write endpoint as a snappy-compressed prompb.WriteRequest.
+package prometheusremotewrite
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+
+	envelopeutil "github.com/cloudfoundry-community/datadog-firehose-nozzle/providers/envelope"
+)
+
+type Client struct {
+	remoteWriteURL string
+	prefix         string
+	deployment     string
+	ip             string
+	metricPoints   map[metricKey]metricValue
+	httpClient     http.Client
+}
+
+type metricKey struct {
+	eventType  events.Envelope_EventType
+	name       string
+	deployment string
+	job        string
+	index      string
+	ip         string
+}
+
+type metricValue struct {
+	tags   []string
+	points []point
+}
+
+type point struct {
+	timestampMs int64
+	value       float64
+}
+
+func New(remoteWriteURL string, prefix string, deployment string, ip string) *Client {
+	return &Client{
+		remoteWriteURL: remoteWriteURL,
+		prefix:         prefix,
+		deployment:     deployment,
+		ip:             ip,
+		metricPoints:   make(map[metricKey]metricValue),
+		httpClient:     http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *Client) AlertSlowConsumerError() {
+	c.addInternalMetric("slowConsumerAlert", 1)
+}
+
+func (c *Client) AddMetric(envelope *events.Envelope) {
+	if envelope.GetEventType() != events.Envelope_ValueMetric && envelope.GetEventType() != events.Envelope_CounterEvent {
+		return
+	}
+
+	key := metricKey{
+		eventType:  envelope.GetEventType(),
+		name:       envelopeutil.Name(envelope),
+		deployment: envelope.GetDeployment(),
+		job:        envelope.GetJob(),
+		index:      envelope.GetIndex(),
+		ip:         envelope.GetIp(),
+	}
+
+	mVal := c.metricPoints[key]
+	mVal.tags = envelopeutil.Tags(envelope)
+	mVal.points = append(mVal.points, point{
+		timestampMs: envelope.GetTimestamp() / int64(time.Millisecond),
+		value:       envelopeutil.Value(envelope),
+	})
+	c.metricPoints[key] = mVal
+}
+
+func (c *Client) PostMetrics() error {
+	req := c.buildWriteRequest()
+	c.metricPoints = make(map[metricKey]metricValue)
+
+	if len(req.Timeseries) == 0 {
+		return nil
+	}
+
+	return c.send(req)
+}
+
+func (c *Client) buildWriteRequest() *prompb.WriteRequest {
+	req := &prompb.WriteRequest{}
+
+	for key, mVal := range c.metricPoints {
+		labels := []prompb.Label{{Name: "__name__", Value: metricName(c.prefix + key.name)}}
+		for _, tag := range mVal.tags {
+			name, value := splitTag(tag)
+			labels = append(labels, prompb.Label{Name: name, Value: value})
+		}
+
+		samples := make([]prompb.Sample, len(mVal.points))
+		for i, p := range mVal.points {
+			samples[i] = prompb.Sample{Timestamp: p.timestampMs, Value: p.value}
+		}
+
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{Labels: labels, Samples: samples})
+	}
+
+	return req
+}
+
+func (c *Client) send(req *prompb.WriteRequest) error {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("prometheusremotewrite: marshal request: %s", err)
+	}
+	compressed := snappy.Encode(nil, data)
+
+	httpReq, err := http.NewRequest("POST", c.remoteWriteURL, bytes.NewReader(compressed))
+	if err != nil {
+		return fmt.Errorf("prometheusremotewrite: new request: %s", err)
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("prometheusremotewrite: write request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		return fmt.Errorf("prometheusremotewrite: write returned HTTP %s", resp.Status)
+	}
+
+	log.Printf("prometheusremotewrite: wrote metrics, response: %s", resp.Status)
+	return nil
+}
+
+func (c *Client) addInternalMetric(name string, value float64) {
+	key := metricKey{name: name, deployment: c.deployment, ip: c.ip}
+	mVal := c.metricPoints[key]
+	mVal.tags = []string{"ip:" + c.ip, "deployment:" + c.deployment}
+	mVal.points = append(mVal.points, point{timestampMs: time.Now().UnixNano() / int64(time.Millisecond), value: value})
+	c.metricPoints[key] = mVal
+}
+
+// splitTag splits a shared-format "key:value" tag, as produced by
+// envelopeutil.Tags, into a Prometheus label name/value pair.
+func splitTag(tag string) (name string, value string) {
+	for i := 0; i < len(tag); i++ {
+		if tag[i] == ':' {
+			return metricName(tag[:i]), tag[i+1:]
+		}
+	}
+	return metricName(tag), ""
+}
+
+// metricName sanitizes a metric or label name to Prometheus's [a-zA-Z_:][a-zA-Z0-9_:]* charset.
+func metricName(name string) string {
+	out := []byte(name)
+	for i, b := range out {
+		isAlpha := (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || b == '_' || b == ':'
+		isDigit := b >= '0' && b <= '9'
+		if isAlpha || (isDigit && i > 0) {
+			continue
+		}
+		out[i] = '_'
+	}
+	return string(out)
+}
@@ -0,0 +1,79 @@
+package prometheusremotewrite
+
+import (
+	"testing"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func testValueEnvelope(name string, value float64) *events.Envelope {
+	eventType := events.Envelope_ValueMetric
+	origin := "origin"
+	job := "router"
+	return &events.Envelope{
+		Origin:    &origin,
+		EventType: &eventType,
+		Job:       &job,
+		ValueMetric: &events.ValueMetric{
+			Name:  &name,
+			Value: &value,
+		},
+	}
+}
+
+func TestBuildWriteRequestSetsNameLabelAndSample(t *testing.T) {
+	c := New("http://prometheus.example.com/api/v1/write", "prefix.", "cf-warden", "10.0.0.1")
+	c.AddMetric(testValueEnvelope("latency", 42))
+
+	req := c.buildWriteRequest()
+	if len(req.Timeseries) != 1 {
+		t.Fatalf("got %d timeseries, want 1", len(req.Timeseries))
+	}
+
+	ts := req.Timeseries[0]
+	var nameLabel, jobLabel string
+	for _, l := range ts.Labels {
+		switch l.Name {
+		case "__name__":
+			nameLabel = l.Value
+		case "job":
+			jobLabel = l.Value
+		}
+	}
+	if want := "prefix_origin_latency"; nameLabel != want {
+		t.Errorf("__name__ = %q, want %q", nameLabel, want)
+	}
+	if want := "router"; jobLabel != want {
+		t.Errorf("job = %q, want %q", jobLabel, want)
+	}
+
+	if len(ts.Samples) != 1 || ts.Samples[0].Value != 42 {
+		t.Fatalf("samples = %+v, want a single sample with value 42", ts.Samples)
+	}
+}
+
+func TestMetricNameSanitizesReservedCharacters(t *testing.T) {
+	if got, want := metricName("nozzle.latency-p99"), "nozzle_latency_p99"; got != want {
+		t.Errorf("metricName() = %q, want %q", got, want)
+	}
+}
+
+func TestSplitTagSanitizesLabelName(t *testing.T) {
+	name, value := splitTag("bosh-job:router")
+	if name != "bosh_job" || value != "router" {
+		t.Errorf("splitTag() = (%q, %q), want (%q, %q)", name, value, "bosh_job", "router")
+	}
+}
+
+func TestPostMetricsClearsBufferedPoints(t *testing.T) {
+	c := New("http://127.0.0.1:0", "prefix.", "cf-warden", "10.0.0.1")
+	c.AddMetric(testValueEnvelope("latency", 42))
+
+	// The write itself will fail since nothing is listening, but the
+	// buffered points should still be cleared for the next flush window.
+	_ = c.PostMetrics()
+
+	if len(c.metricPoints) != 0 {
+		t.Fatalf("metricPoints after PostMetrics = %d, want 0", len(c.metricPoints))
+	}
+}
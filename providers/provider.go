@@ -0,0 +1,14 @@
+// Package providers defines the backend-agnostic interface the nozzle's main
+// loop talks to, plus a factory for building the backend selected by config.
+package providers
+
+import "github.com/cloudfoundry-community/datadog-firehose-nozzle/providers/metricsprovider"
+
+// MetricsProvider is implemented by each metrics backend (Datadog, InfluxDB,
+// Prometheus remote_write, ...). The nozzle feeds every firehose envelope to
+// AddMetric and calls PostMetrics on each flush tick; it never needs to know
+// which backend is behind the interface.
+//
+// It's an alias for metricsprovider.MetricsProvider so backend packages like
+// providers/multi can implement it without importing this package back.
+type MetricsProvider = metricsprovider.MetricsProvider
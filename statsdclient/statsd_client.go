@@ -0,0 +1,174 @@
+// Package statsdclient implements providers.MetricsProvider by emitting
+// DogStatsD lines over UDP or a Unix datagram socket to a local Datadog
+// Agent, as a lower-latency alternative to datadogclient's HTTP series API.
+// Unlike datadogclient it doesn't wait for a periodic flush: each metric is
+// queued onto a pending packet as soon as it arrives and written out the
+// moment that packet would exceed the configured MTU, and it never needs a
+// Datadog API key.
+package statsdclient
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+
+	envelopeutil "github.com/cloudfoundry-community/datadog-firehose-nozzle/providers/envelope"
+)
+
+// DefaultUDPMaxPacketSize keeps packets under the common 1500 byte Ethernet
+// MTU once IP/UDP headers are accounted for.
+const DefaultUDPMaxPacketSize = 1432
+
+// DefaultUDSMaxPacketSize is generous since a Unix datagram socket isn't
+// constrained by a network MTU.
+const DefaultUDSMaxPacketSize = 8192
+
+type Client struct {
+	network          string // "udp" or "unixgram"
+	address          string
+	prefix           string
+	maxPacketSize    int
+	conn             net.Conn
+	mu               sync.Mutex
+	pending          string
+	lastCounterTotal map[metricKey]uint64
+}
+
+type metricKey struct {
+	name       string
+	deployment string
+	job        string
+	index      string
+	ip         string
+}
+
+// New dials network ("udp" or "unixgram") and address, returning a Client
+// that writes DogStatsD lines to the connection.
+func New(network string, address string, prefix string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("statsdclient: dial %s %s: %s", network, address, err)
+	}
+
+	maxPacketSize := DefaultUDPMaxPacketSize
+	if network == "unixgram" {
+		maxPacketSize = DefaultUDSMaxPacketSize
+	}
+
+	return &Client{
+		network:          network,
+		address:          address,
+		prefix:           prefix,
+		maxPacketSize:    maxPacketSize,
+		conn:             conn,
+		lastCounterTotal: make(map[metricKey]uint64),
+	}, nil
+}
+
+// SetMaxPacketSize overrides the default per-network MTU used to batch lines.
+func (c *Client) SetMaxPacketSize(n int) {
+	c.maxPacketSize = n
+}
+
+func (c *Client) AlertSlowConsumerError() {
+	c.enqueue(fmt.Sprintf("%sslowConsumerAlert:1|c", c.prefix))
+}
+
+func (c *Client) AddMetric(envelope *events.Envelope) {
+	switch envelope.GetEventType() {
+	case events.Envelope_ValueMetric:
+		c.enqueue(c.gaugeLine(envelope))
+	case events.Envelope_CounterEvent:
+		if line, ok := c.counterLine(envelope); ok {
+			c.enqueue(line)
+		}
+	}
+}
+
+// PostMetrics flushes whatever's been buffered but hasn't yet filled a
+// packet. Everything else is already sent as soon as enqueue fills one, so
+// there's rarely much left here.
+func (c *Client) PostMetrics() error {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = ""
+	c.mu.Unlock()
+
+	if pending != "" {
+		c.write(pending)
+	}
+	return nil
+}
+
+func (c *Client) gaugeLine(envelope *events.Envelope) string {
+	name := c.prefix + envelopeutil.Name(envelope)
+	return fmt.Sprintf("%s:%g|g%s", name, envelope.GetValueMetric().GetValue(), tagSuffix(envelope))
+}
+
+// counterLine renders a CounterEvent as a |c delta between this total and
+// the last total seen for the same series, since DogStatsD counters are
+// deltas but the firehose gives us a running total.
+func (c *Client) counterLine(envelope *events.Envelope) (string, bool) {
+	key := metricKey{
+		name:       envelopeutil.Name(envelope),
+		deployment: envelope.GetDeployment(),
+		job:        envelope.GetJob(),
+		index:      envelope.GetIndex(),
+		ip:         envelope.GetIp(),
+	}
+
+	total := envelope.GetCounterEvent().GetTotal()
+
+	c.mu.Lock()
+	last, seen := c.lastCounterTotal[key]
+	c.lastCounterTotal[key] = total
+	c.mu.Unlock()
+
+	if !seen || total < last {
+		// First sighting, or the origin restarted and its counter reset:
+		// skip this sample rather than emit a bogus (possibly negative) delta.
+		return "", false
+	}
+
+	delta := total - last
+	return fmt.Sprintf("%s:%d|c%s", c.prefix+key.name, delta, tagSuffix(envelope)), true
+}
+
+// tagSuffix renders the shared "key:value" tags as a DogStatsD "|#..." suffix.
+func tagSuffix(envelope *events.Envelope) string {
+	tags := envelopeutil.Tags(envelope)
+	if len(tags) == 0 {
+		return ""
+	}
+	return "|#" + strings.Join(tags, ",")
+}
+
+// enqueue appends line to the pending packet, flushing first if it
+// wouldn't fit, so consecutive metrics genuinely share one UDP/UDS write
+// instead of paying one syscall per sample.
+func (c *Client) enqueue(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	candidate := line
+	if c.pending != "" {
+		candidate = c.pending + "\n" + line
+	}
+
+	if c.pending != "" && len(candidate) > c.maxPacketSize {
+		c.write(c.pending)
+		candidate = line
+	}
+
+	c.pending = candidate
+}
+
+func (c *Client) write(packet string) {
+	if _, err := c.conn.Write([]byte(packet)); err != nil {
+		log.Printf("statsdclient: write to %s %s failed: %s", c.network, c.address, err)
+	}
+}
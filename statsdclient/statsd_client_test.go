@@ -0,0 +1,133 @@
+package statsdclient
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func testCounterEnvelope(name string, total uint64) *events.Envelope {
+	eventType := events.Envelope_CounterEvent
+	origin := "origin"
+	return &events.Envelope{
+		Origin:    &origin,
+		EventType: &eventType,
+		CounterEvent: &events.CounterEvent{
+			Name:  &name,
+			Total: &total,
+		},
+	}
+}
+
+func TestCounterLineFirstSightingIsSkipped(t *testing.T) {
+	c := &Client{lastCounterTotal: make(map[metricKey]uint64)}
+
+	_, ok := c.counterLine(testCounterEnvelope("requests", 10))
+	if ok {
+		t.Fatal("expected the first sighting of a counter to be skipped")
+	}
+}
+
+func TestCounterLineEmitsDelta(t *testing.T) {
+	c := &Client{lastCounterTotal: make(map[metricKey]uint64)}
+
+	c.counterLine(testCounterEnvelope("requests", 10))
+	line, ok := c.counterLine(testCounterEnvelope("requests", 15))
+	if !ok {
+		t.Fatal("expected a delta once a prior total has been seen")
+	}
+	if want := "origin.requests:5|c"; line != want {
+		t.Fatalf("counterLine() = %q, want %q", line, want)
+	}
+}
+
+func TestCounterLineSkipsOnReset(t *testing.T) {
+	c := &Client{lastCounterTotal: make(map[metricKey]uint64)}
+
+	c.counterLine(testCounterEnvelope("requests", 100))
+	_, ok := c.counterLine(testCounterEnvelope("requests", 3))
+	if ok {
+		t.Fatal("expected a restarted (lower) counter total to be skipped rather than emit a negative delta")
+	}
+
+	// The next sample establishes a fresh baseline rather than staying stuck.
+	line, ok := c.counterLine(testCounterEnvelope("requests", 8))
+	if !ok {
+		t.Fatal("expected a delta once a new baseline has been recorded after the reset")
+	}
+	if want := "origin.requests:5|c"; line != want {
+		t.Fatalf("counterLine() = %q, want %q", line, want)
+	}
+}
+
+// newTestClient wires c.conn to one end of a net.Pipe and drains whatever's
+// written to it, so enqueue's flushes have somewhere to go.
+func newTestClient(t *testing.T, maxPacketSize int) (*Client, <-chan string) {
+	server, client := net.Pipe()
+	packets := make(chan string, 16)
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := server.Read(buf)
+			if n > 0 {
+				packets <- string(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	t.Cleanup(func() { client.Close(); server.Close() })
+
+	return &Client{
+		conn:          client,
+		maxPacketSize: maxPacketSize,
+	}, packets
+}
+
+func TestEnqueueBatchesLinesIntoOnePacket(t *testing.T) {
+	c, _ := newTestClient(t, 100)
+
+	c.enqueue("metric.one:1|g")
+	c.enqueue("metric.two:2|g")
+
+	if want := "metric.one:1|g\nmetric.two:2|g"; c.pending != want {
+		t.Fatalf("pending = %q, want %q", c.pending, want)
+	}
+}
+
+func TestEnqueueFlushesBeforeOverflowing(t *testing.T) {
+	c, packets := newTestClient(t, 20)
+
+	c.enqueue("12345")
+	c.enqueue("67890")
+	c.enqueue("abcdefghijklmnopqrstuvwxyz")
+
+	flushed := <-packets
+	if want := "12345\n67890"; flushed != want {
+		t.Fatalf("flushed packet = %q, want %q", flushed, want)
+	}
+	if c.pending != "abcdefghijklmnopqrstuvwxyz" {
+		t.Fatalf("pending after flush = %q, want the oversized line to start the next packet", c.pending)
+	}
+}
+
+func TestPostMetricsFlushesRemainingPending(t *testing.T) {
+	c, packets := newTestClient(t, 100)
+
+	c.enqueue("metric.one:1|g")
+	if err := c.PostMetrics(); err != nil {
+		t.Fatalf("PostMetrics() returned error: %s", err)
+	}
+
+	flushed := <-packets
+	if want := "metric.one:1|g"; flushed != want {
+		t.Fatalf("flushed packet = %q, want %q", flushed, want)
+	}
+	if c.pending != "" {
+		t.Fatalf("pending after PostMetrics = %q, want empty", c.pending)
+	}
+}